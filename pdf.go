@@ -5,34 +5,85 @@ import (
 	"compress/zlib"
 	"encoding/ascii85"
 	"fmt"
+	"image"
 	"io"
 	"strings"
 )
 
+// PDFWriter writes a PDF document consisting of one or more pages. Objects
+// that can be shared between pages (fonts, graphics states, ...) are
+// deduplicated at the document level, while each page keeps its own
+// resource dictionary and content stream.
 type PDFWriter struct {
 	w   io.Writer
 	err error
 
-	width, height float64
-	pos           int
-	objOffsets    []int
+	pos      int
+	xref     []pdfXrefEntry
+	compress bool
+	objStm   []pdfPendingObject
 
-	resources      PDFDict
-	graphicsStates map[float64]PDFName
-	fonts          map[*Font]PDFName
+	pages       []*PDFPage
+	fontStates  map[*Font]*pdfFontState
+	fontOrder   []*Font
+	gsRefs      map[float64]PDFRef
+	imageRefs   map[image.Image]PDFRef
+	shadingRefs map[pdfAxialShading]PDFRef
+	patternRefs map[string]PDFRef
+
+	encrypt           *pdfEncryptState
+	encryptSuppressed bool
+	curObjNum         int
+
+	sign *pdfSignState
+}
+
+// shouldEncrypt reports whether the value currently being written by
+// writeVal (a string or stream) must be encrypted: the document has a
+// security handler installed, we're not writing the /Encrypt dictionary
+// itself (which can never reference its own encryption), and we're inside
+// a real indirect object rather than the trailer or an object buffered for
+// an ObjStm (whose container stream is encrypted as a whole instead).
+func (w *PDFWriter) shouldEncrypt() bool {
+	return w.encrypt != nil && !w.encryptSuppressed && w.curObjNum != 0
+}
+
+// PDFWriterOption configures a PDFWriter at construction time.
+type PDFWriterOption func(*PDFWriter)
+
+// PDFCompress enables PDF 1.5+ cross-reference streams and compressed
+// object streams, which batch the document's non-stream objects into a few
+// FlateDecode'd ObjStm streams instead of emitting them as plain text. This
+// shrinks output considerably but requires a PDF 1.5+ capable reader.
+func PDFCompress() PDFWriterOption {
+	return func(w *PDFWriter) {
+		w.compress = true
+	}
 }
 
-func NewPDFWriter(writer io.Writer, width, height float64) *PDFWriter {
+// NewPDFWriter returns a new PDFWriter. Call NewPage to start adding pages
+// and Close to finalize the document.
+func NewPDFWriter(writer io.Writer, opts ...PDFWriterOption) *PDFWriter {
 	w := &PDFWriter{
-		w:              writer,
-		width:          width,
-		height:         height,
-		resources:      PDFDict{"ExtGState": PDFDict{}, "Font": PDFDict{}},
-		graphicsStates: map[float64]PDFName{},
-		fonts:          map[*Font]PDFName{},
+		w:           writer,
+		fontStates:  map[*Font]*pdfFontState{},
+		gsRefs:      map[float64]PDFRef{},
+		imageRefs:   map[image.Image]PDFRef{},
+		shadingRefs: map[pdfAxialShading]PDFRef{},
+		patternRefs: map[string]PDFRef{},
+	}
+	for _, opt := range opts {
+		opt(w)
 	}
 
-	w.write("%%PDF-1.7\n")
+	// PDF 1.5 is the minimum version that defines cross-reference streams
+	// and object streams, so with PDFCompress the header declares 1.5 (see
+	// writeXRefStream); otherwise it declares 1.7.
+	version := "1.7"
+	if w.compress {
+		version = "1.5"
+	}
+	w.write("%%PDF-%s\n", version)
 	return w
 }
 
@@ -59,6 +110,13 @@ type PDFName string
 type PDFArray []interface{}
 type PDFDict map[PDFName]interface{}
 type PDFFilter string
+
+// PDFRaw is written to the document verbatim, with no escaping, quoting or
+// encryption applied. It exists for the rare entry - a /ByteRange or a
+// signature /Contents placeholder - that must occupy an exact, pre-agreed
+// number of bytes so it can be patched in place after the fact.
+type PDFRaw string
+
 type PDFStream struct {
 	dict    PDFDict
 	filters []PDFFilter
@@ -68,17 +126,25 @@ type PDFStream struct {
 const (
 	PDFFilterASCII85 PDFFilter = "ASCII85Decode"
 	PDFFilterFlate   PDFFilter = "FlateDecode"
+	PDFFilterDCT     PDFFilter = "DCTDecode"
 )
 
 func (w *PDFWriter) writeVal(i interface{}) {
 	switch v := i.(type) {
+	case bool:
+		w.write("%v", v)
 	case int, float64:
 		w.write("%v", v)
 	case string:
+		if w.shouldEncrypt() {
+			v = string(w.encrypt.encrypt([]byte(v), w.curObjNum, 0))
+		}
 		v = strings.Replace(v, `\`, `\\`, -1)
 		v = strings.Replace(v, `(`, `\(`, -1)
 		v = strings.Replace(v, `)`, `\)`, -1)
 		w.write("(%v)", v)
+	case PDFRaw:
+		w.write("%v", string(v))
 	case PDFRef:
 		w.write("%v 0 R", v)
 	case PDFName:
@@ -123,6 +189,10 @@ func (w *PDFWriter) writeVal(i interface{}) {
 			b = b2.Bytes()
 		}
 
+		if w.shouldEncrypt() {
+			b = w.encrypt.encrypt(b, w.curObjNum, 0)
+		}
+
 		dict := v.dict
 		if dict == nil {
 			dict = PDFDict{}
@@ -140,87 +210,281 @@ func (w *PDFWriter) writeVal(i interface{}) {
 	}
 }
 
-func (w *PDFWriter) GetOpacityGS(a float64) PDFName {
-	if name, ok := w.graphicsStates[a]; ok {
-		return name
-	}
-	name := PDFName(fmt.Sprintf("GS%d", len(w.graphicsStates)))
-	w.graphicsStates[a] = name
-	w.resources["ExtGState"].(PDFDict)[name] = PDFDict{
-		"ca": a,
+// PDFPage represents a single page of the document. It owns its own content
+// stream and resource dictionary; fonts and graphics states are looked up
+// from (and, if new, added to) the document-wide caches on PDFWriter so that
+// the underlying objects are only embedded once.
+type PDFPage struct {
+	writer *PDFWriter
+
+	width, height float64
+	rotate        int
+
+	resources      PDFDict
+	graphicsStates map[float64]PDFName
+	fonts          map[*Font]PDFName
+	images         map[image.Image]PDFName
+	shadings       map[pdfAxialShading]PDFName
+	patterns       map[string]PDFName
+
+	content bytes.Buffer
+}
+
+// NewPage starts a new page of the given size (in user space units) and
+// returns it. Pages are emitted into the document's Pages tree in the order
+// they were created.
+func (w *PDFWriter) NewPage(width, height float64) *PDFPage {
+	page := &PDFPage{
+		writer: w,
+		width:  width,
+		height: height,
+		resources: PDFDict{
+			"ExtGState": PDFDict{},
+			"Font":      PDFDict{},
+			"XObject":   PDFDict{},
+			"Shading":   PDFDict{},
+			"Pattern":   PDFDict{},
+		},
+		graphicsStates: map[float64]PDFName{},
+		fonts:          map[*Font]PDFName{},
+		images:         map[image.Image]PDFName{},
+		shadings:       map[pdfAxialShading]PDFName{},
+		patterns:       map[string]PDFName{},
 	}
-	return name
+	w.pages = append(w.pages, page)
+	return page
+}
+
+// SetRotate sets the page's /Rotate entry, normalized to one of 0, 90, 180
+// or 270 degrees clockwise.
+func (p *PDFPage) SetRotate(degrees int) {
+	p.rotate = ((degrees/90)%4 + 4) % 4 * 90
+}
+
+// Write appends raw content-stream bytes to the page, implementing
+// io.Writer so that higher-level content builders can target a page
+// directly.
+func (p *PDFPage) Write(b []byte) (int, error) {
+	return p.content.Write(b)
 }
 
-func (w *PDFWriter) GetFont(f *Font) PDFName {
-	if name, ok := w.fonts[f]; ok {
+// GetOpacityGS returns the resource name of an ExtGState with constant alpha
+// a, creating and registering the underlying (document-shared) object if
+// this is the first page to use it.
+func (p *PDFPage) GetOpacityGS(a float64) PDFName {
+	if name, ok := p.graphicsStates[a]; ok {
 		return name
 	}
 
-	mimetype, _ := f.Raw()
-	if mimetype != "font/ttf" {
-		panic("only TTF format support for embedding fonts in PDFs")
+	ref, ok := p.writer.gsRefs[a]
+	if !ok {
+		ref = p.writer.WriteObject(PDFDict{
+			"Type": PDFName("ExtGState"),
+			"ca":   a,
+		})
+		p.writer.gsRefs[a] = ref
 	}
 
-	// TODO: implement
-	baseFont := strings.ReplaceAll(f.name, " ", "_")
-	ref := w.WriteObject(PDFStream{
-		dict: PDFDict{
-			"Type":     PDFName("Font"),
-			"Subtype":  PDFName("TrueType"),
-			"BaseFont": PDFName(baseFont),
-		},
-	})
+	name := PDFName(fmt.Sprintf("GS%d", len(p.graphicsStates)))
+	p.graphicsStates[a] = name
+	p.resources["ExtGState"].(PDFDict)[name] = ref
+	return name
+}
+
+// GetFont returns the resource name of font f on this page, registering the
+// font with the document the first time it is requested by any page. The
+// font is only actually embedded (subset to the glyphs used via
+// EncodeString) once the document is closed.
+func (p *PDFPage) GetFont(f *Font) PDFName {
+	if name, ok := p.fonts[f]; ok {
+		return name
+	}
 
-	name := PDFName(fmt.Sprintf("F%d", len(w.fonts)))
-	w.fonts[f] = name
-	w.resources["Font"].(PDFDict)[name] = ref
+	state := p.writer.registerFont(f)
+	name := PDFName(fmt.Sprintf("F%d", len(p.fonts)))
+	p.fonts[f] = name
+	p.resources["Font"].(PDFDict)[name] = state.ref
 	return name
 }
 
+// WriteObject writes val as a new indirect object and returns its reference.
+// When the writer was created with PDFCompress, non-stream objects (streams
+// can never live in an object stream) are instead buffered and flushed in
+// batches into compressed ObjStm objects; the returned reference is
+// transparent to the caller either way.
 func (w *PDFWriter) WriteObject(val interface{}) PDFRef {
-	w.objOffsets = append(w.objOffsets, w.pos)
-	w.write("%v 0 obj\n", len(w.objOffsets))
+	ref := w.reserveRef()
+	w.resolveObject(ref, val)
+	return ref
+}
+
+// reserveRef allocates an object number without writing anything, so that
+// other objects may refer to it before its value is known. It must later be
+// given a value with resolveObject.
+func (w *PDFWriter) reserveRef() PDFRef {
+	num := len(w.xref) + 1
+	w.xref = append(w.xref, pdfXrefEntry{})
+	return PDFRef(num)
+}
+
+// resolveObject writes val as the indirect object identified by ref,
+// previously allocated by reserveRef (or by WriteObject itself). Like
+// WriteObject, non-stream values are routed into an ObjStm when the writer
+// was created with PDFCompress.
+func (w *PDFWriter) resolveObject(ref PDFRef, val interface{}) {
+	if w.compress {
+		if _, isStream := val.(PDFStream); !isStream {
+			w.bufferCompressedObject(ref, val)
+			return
+		}
+	}
+	w.writeDirectObject(ref, val)
+}
+
+// writeDirectObject writes val as a classic, uncompressed indirect object at
+// the writer's current position.
+func (w *PDFWriter) writeDirectObject(ref PDFRef, val interface{}) {
+	w.xref[int(ref)-1] = pdfXrefEntry{kind: pdfXrefUncompressed, a: w.pos}
+	w.write("%v 0 obj\n", ref)
+
+	prevObjNum := w.curObjNum
+	w.curObjNum = int(ref)
 	w.writeVal(val)
+	w.curObjNum = prevObjNum
+
 	w.write("\nendobj\n")
-	return PDFRef(len(w.objOffsets))
 }
 
 func (w *PDFWriter) Close() error {
-	contents := PDFArray{}
-	for j := 0; j < len(w.objOffsets); j++ {
-		contents = append(contents, PDFRef(j+1))
+	// Signing needs to hash and patch the document's final bytes, which
+	// isn't possible against a plain io.Writer: buffer the whole document
+	// and only hand it to the real destination once it's been signed.
+	var signDst io.Writer
+	if w.sign != nil {
+		signDst = w.w
+		w.w = &bytes.Buffer{}
 	}
 
-	refPage := w.WriteObject(PDFDict{
-		"Type":      PDFName("Page"),
-		"Parent":    PDFRef(len(w.objOffsets) + 2),
-		"MediaBox":  PDFArray{0.0, 0.0, w.width, w.height},
-		"Resources": w.resources,
-		"Contents":  contents,
-	})
+	// The signature field's widget annotation must be listed in the first
+	// page's /Annots and its AcroForm in the Catalog, but both are only
+	// built once every page is known below, so their object numbers are
+	// reserved up front.
+	var refWidget, refAcroForm PDFRef
+	if w.sign != nil {
+		refWidget = w.reserveRef()
+		refAcroForm = w.reserveRef()
+	}
 
-	refPages := w.WriteObject(PDFDict{
+	// Reserve the object numbers for each page's content stream and page
+	// object, and then for the Pages tree, up front, so that every page can
+	// refer to its parent even if an ObjStm is flushed while pages are
+	// being written.
+	refContents := make([]PDFRef, len(w.pages))
+	refPageObjs := make([]PDFRef, len(w.pages))
+	for i := range w.pages {
+		refContents[i] = w.reserveRef()
+		refPageObjs[i] = w.reserveRef()
+	}
+	refPages := w.reserveRef()
+
+	kids := PDFArray{}
+	for i, page := range w.pages {
+		refContent := refContents[i]
+		w.resolveObject(refContent, PDFStream{
+			filters: []PDFFilter{PDFFilterFlate},
+			b:       page.content.Bytes(),
+		})
+
+		dict := PDFDict{
+			"Type":      PDFName("Page"),
+			"Parent":    refPages,
+			"MediaBox":  PDFArray{0.0, 0.0, page.width, page.height},
+			"Resources": page.resources,
+			"Contents":  refContent,
+		}
+		if page.rotate != 0 {
+			dict["Rotate"] = page.rotate
+		}
+		if w.sign != nil && i == 0 {
+			dict["Annots"] = PDFArray{refWidget}
+		}
+		w.resolveObject(refPageObjs[i], dict)
+		kids = append(kids, refPageObjs[i])
+	}
+
+	w.resolveObject(refPages, PDFDict{
 		"Type":  PDFName("Pages"),
-		"Kids":  PDFArray{refPage},
-		"Count": 1,
+		"Kids":  kids,
+		"Count": len(w.pages),
 	})
 
-	refCatalog := w.WriteObject(PDFDict{
+	catalog := PDFDict{
 		"Type":  PDFName("Catalog"),
 		"Pages": refPages,
-	})
+	}
+	if w.sign != nil {
+		catalog["AcroForm"] = refAcroForm
+	}
+	refCatalog := w.WriteObject(catalog)
+	w.finalizeFonts()
+
+	var refEncrypt PDFRef
+	if w.encrypt != nil {
+		// The /Encrypt dictionary's own O/U/OE/UE/Perms strings describe
+		// the encryption itself and are never encrypted. It also must never
+		// be routed into a compressed ObjStm (ISO 32000-1 7.5.8.2): readers
+		// need /Encrypt in plain text up front to derive the file key
+		// before they can decrypt anything else, including any ObjStm.
+		w.encryptSuppressed = true
+		refEncrypt = w.reserveRef()
+		w.writeDirectObject(refEncrypt, w.encrypt.dict())
+		w.encryptSuppressed = false
+	}
+
+	if w.sign != nil {
+		w.writeSignatureField(refWidget, refAcroForm, kids[0].(PDFRef))
+	}
+
+	w.flushObjStm()
 
+	var err error
+	if w.compress {
+		err = w.writeXRefStream(refCatalog, refEncrypt)
+	} else {
+		err = w.writeXRefTable(refCatalog, refEncrypt)
+	}
+	if err != nil {
+		return err
+	}
+
+	if w.sign != nil {
+		return w.finalizeSignature(signDst)
+	}
+	return nil
+}
+
+// trailerDict builds the trailer/XRef-stream dictionary entries shared by
+// both xref table styles.
+func (w *PDFWriter) trailerDict(refCatalog, refEncrypt PDFRef) PDFDict {
+	dict := PDFDict{"Root": refCatalog}
+	if w.encrypt != nil {
+		dict["Encrypt"] = refEncrypt
+		dict["ID"] = PDFArray{string(w.encrypt.id1), string(w.encrypt.id2)}
+	}
+	return dict
+}
+
+// writeXRefTable writes the classic plain-text xref table and trailer.
+func (w *PDFWriter) writeXRefTable(refCatalog, refEncrypt PDFRef) error {
 	xrefOffset := w.pos
-	w.write("xref\n0 %d\n0000000000 65535 f\n", len(w.objOffsets)+1)
-	for _, objOffset := range w.objOffsets {
-		w.write("%010d 00000 n\n", objOffset)
+	w.write("xref\n0 %d\n0000000000 65535 f\n", len(w.xref)+1)
+	for _, entry := range w.xref {
+		w.write("%010d 00000 n\n", entry.a)
 	}
 	w.write("trailer\n")
-	w.writeVal(PDFDict{
-		"Root": refCatalog,
-		"Size": len(w.objOffsets),
-	})
-	w.write("\nstarxref\n%v\n%%%%EOF", xrefOffset)
+	trailer := w.trailerDict(refCatalog, refEncrypt)
+	trailer["Size"] = len(w.xref) + 1
+	w.writeVal(trailer)
+	w.write("\nstartxref\n%v\n%%%%EOF", xrefOffset)
 	return w.err
 }
@@ -0,0 +1,329 @@
+package canvas
+
+import (
+	"fmt"
+	"image"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Coordinates passed to PDFPage's drawing methods are in the page's own
+// user space: origin at the bottom-left corner of the MediaBox, y
+// increasing upward, exactly as PDF content streams expect. Callers
+// targeting a top-down coordinate system should flip y (height - y)
+// themselves before calling in.
+
+// op writes a content-stream operator to the page. Arguments are formatted
+// with fmt's %v, so callers pass float arguments through num first.
+func (p *PDFPage) op(format string, args ...interface{}) {
+	fmt.Fprintf(p, format, args...)
+}
+
+// num formats a PDF content-stream number: fixed-point, never scientific
+// notation, with no more digits than necessary.
+func num(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// MoveTo begins a new subpath at (x, y).
+func (p *PDFPage) MoveTo(x, y float64) {
+	p.op("%v %v m\n", num(x), num(y))
+}
+
+// LineTo appends a straight line segment from the current point to (x, y).
+func (p *PDFPage) LineTo(x, y float64) {
+	p.op("%v %v l\n", num(x), num(y))
+}
+
+// CurveTo appends a cubic Bezier segment from the current point to (x3, y3),
+// using (x1, y1) and (x2, y2) as control points.
+func (p *PDFPage) CurveTo(x1, y1, x2, y2, x3, y3 float64) {
+	p.op("%v %v %v %v %v %v c\n", num(x1), num(y1), num(x2), num(y2), num(x3), num(y3))
+}
+
+// Close closes the current subpath with a straight line back to its start.
+func (p *PDFPage) Close() {
+	p.op("h\n")
+}
+
+// Fill paints the current path using the nonzero winding number rule and
+// clears it, per the f operator.
+func (p *PDFPage) Fill() {
+	p.op("f\n")
+}
+
+// Stroke paints the current path's outline and clears it, per the S
+// operator.
+func (p *PDFPage) Stroke() {
+	p.op("S\n")
+}
+
+// Clip intersects the clipping path with the current path, using the
+// nonzero winding number rule. Per the PDF imaging model this only takes
+// effect after the next path-painting operator, so Clip emits a no-op
+// paint (n) itself.
+func (p *PDFPage) Clip() {
+	p.op("W n\n")
+}
+
+// SetRGB sets both the fill and stroke color to (r, g, b), each in [0, 1],
+// in the DeviceRGB color space.
+func (p *PDFPage) SetRGB(r, g, b float64) {
+	p.op("%v %v %v rg\n%v %v %v RG\n", num(r), num(g), num(b), num(r), num(g), num(b))
+}
+
+// SetCMYK sets both the fill and stroke color to (c, m, y, k), each in
+// [0, 1], in the DeviceCMYK color space.
+func (p *PDFPage) SetCMYK(c, m, y, k float64) {
+	p.op("%v %v %v %v k\n%v %v %v %v K\n", num(c), num(m), num(y), num(k), num(c), num(m), num(y), num(k))
+}
+
+// SetGray sets both the fill and stroke color to gray level g, in [0, 1],
+// in the DeviceGray color space.
+func (p *PDFPage) SetGray(g float64) {
+	p.op("%v g\n%v G\n", num(g), num(g))
+}
+
+// SetLineWidth sets the stroking line width, in user space units.
+func (p *PDFPage) SetLineWidth(width float64) {
+	p.op("%v w\n", num(width))
+}
+
+// SetDash sets the stroking dash pattern (alternating on/off lengths, in
+// user space units) and its starting phase. An empty pattern restores a
+// solid line.
+func (p *PDFPage) SetDash(pattern []float64, phase float64) {
+	parts := make([]string, len(pattern))
+	for i, v := range pattern {
+		parts[i] = num(v)
+	}
+	p.op("[%v] %v d\n", strings.Join(parts, " "), num(phase))
+}
+
+// DrawText draws s at (x, y) using font f at the given size, registering f
+// with the page (and, the first time it's seen anywhere in the document,
+// with the document itself) and encoding s through the Type0 font's
+// glyph-ID mapping. The one-off text-positioning matrix is isolated with
+// q/Q so it doesn't affect later content.
+func (p *PDFPage) DrawText(f *Font, size float64, x, y float64, s string) {
+	name := p.GetFont(f)
+	hex := p.writer.EncodeString(f, s)
+	p.op("q\nBT\n/%v %v Tf\n%v %v Td\n<%v> Tj\nET\nQ\n", name, num(size), num(x), num(y), string(hex))
+}
+
+// DrawImage draws img into the rectangle with bottom-left corner (x, y) and
+// size (w, h), registering it as an Image XObject the first time it's drawn
+// anywhere in the document. The one-off placement matrix is isolated with
+// q/Q so it doesn't affect later content.
+//
+// Images that implement an internal Raw() method returning ("image/jpeg",
+// data) - the same convention Font uses for its embedded TrueType data -
+// are embedded as-is with DCTDecode. Everything else is re-encoded as raw
+// 8-bit DeviceRGB with FlateDecode, with a DeviceGray SMask added if any
+// pixel isn't fully opaque.
+func (p *PDFPage) DrawImage(img image.Image, x, y, w, h float64) {
+	// img's concrete type must be comparable to use as a map key (a value
+	// type wrapping a slice, for instance, is not); images that aren't are
+	// simply re-embedded on every call instead of risking a panic.
+	cacheable := reflect.TypeOf(img).Comparable()
+
+	var name PDFName
+	if cacheable {
+		name = p.images[img]
+	}
+	if name == "" {
+		ref := p.writer.registerImage(img)
+		name = PDFName(fmt.Sprintf("Im%d", len(p.resources["XObject"].(PDFDict))))
+		if cacheable {
+			p.images[img] = name
+		}
+		p.resources["XObject"].(PDFDict)[name] = ref
+	}
+
+	p.op("q\n%v 0 0 %v %v %v cm\n/%v Do\nQ\n", num(w), num(h), num(x), num(y), name)
+}
+
+// pdfRawImage is satisfied by images that already carry encoded bytes,
+// mirroring Font's Raw() convention.
+type pdfRawImage interface {
+	Raw() (mimetype string, data []byte)
+}
+
+// registerImage returns the document-wide object reference for img,
+// embedding it as an Image XObject the first time it's seen. Like DrawImage,
+// it only consults (and populates) the dedup cache when img's concrete type
+// is comparable.
+func (w *PDFWriter) registerImage(img image.Image) PDFRef {
+	cacheable := reflect.TypeOf(img).Comparable()
+	if cacheable {
+		if ref, ok := w.imageRefs[img]; ok {
+			return ref
+		}
+	}
+
+	if raw, ok := img.(pdfRawImage); ok {
+		if mimetype, data := raw.Raw(); mimetype == "image/jpeg" {
+			b := img.Bounds()
+			ref := w.WriteObject(PDFStream{
+				dict: PDFDict{
+					"Type":             PDFName("XObject"),
+					"Subtype":          PDFName("Image"),
+					"Width":            b.Dx(),
+					"Height":           b.Dy(),
+					"ColorSpace":       PDFName("DeviceRGB"),
+					"BitsPerComponent": 8,
+				},
+				filters: []PDFFilter{PDFFilterDCT},
+				b:       data,
+			})
+			if cacheable {
+				w.imageRefs[img] = ref
+			}
+			return ref
+		}
+	}
+
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	pixels := make([]byte, 0, width*height*3)
+	alpha := make([]byte, 0, width*height)
+	opaque := true
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			// RGBA returns alpha-premultiplied components; PDF expects
+			// independent color and alpha (the /SMask), so undo that here.
+			if a != 0 {
+				r = r * 0xffff / a
+				g = g * 0xffff / a
+				bl = bl * 0xffff / a
+			}
+			pixels = append(pixels, byte(r>>8), byte(g>>8), byte(bl>>8))
+			alpha = append(alpha, byte(a>>8))
+			if a != 0xffff {
+				opaque = false
+			}
+		}
+	}
+
+	dict := PDFDict{
+		"Type":             PDFName("XObject"),
+		"Subtype":          PDFName("Image"),
+		"Width":            width,
+		"Height":           height,
+		"ColorSpace":       PDFName("DeviceRGB"),
+		"BitsPerComponent": 8,
+	}
+	if !opaque {
+		dict["SMask"] = w.WriteObject(PDFStream{
+			dict: PDFDict{
+				"Type":             PDFName("XObject"),
+				"Subtype":          PDFName("Image"),
+				"Width":            width,
+				"Height":           height,
+				"ColorSpace":       PDFName("DeviceGray"),
+				"BitsPerComponent": 8,
+			},
+			filters: []PDFFilter{PDFFilterFlate},
+			b:       alpha,
+		})
+	}
+
+	ref := w.WriteObject(PDFStream{dict: dict, filters: []PDFFilter{PDFFilterFlate}, b: pixels})
+	if cacheable {
+		w.imageRefs[img] = ref
+	}
+	return ref
+}
+
+// pdfAxialShading is the dedup key for GetAxialShading: two shadings with
+// the same geometry and colors share one underlying object.
+type pdfAxialShading struct {
+	x0, y0, x1, y1 float64
+	c0, c1         [3]float64
+}
+
+// GetAxialShading returns the resource name of a /ShadingType 2 (axial)
+// gradient from color c0 at (x0, y0) to c1 at (x1, y1), each in DeviceRGB,
+// creating and registering the underlying (document-shared) object if this
+// is the first page to use it. Paint it with Shade, which uses the sh
+// operator directly. No shading pattern is created for it, so it cannot be
+// selected as a fill color with SetFillPattern.
+func (p *PDFPage) GetAxialShading(x0, y0, x1, y1 float64, c0, c1 [3]float64) PDFName {
+	key := pdfAxialShading{x0, y0, x1, y1, c0, c1}
+	if name, ok := p.shadings[key]; ok {
+		return name
+	}
+
+	ref, ok := p.writer.shadingRefs[key]
+	if !ok {
+		ref = p.writer.WriteObject(PDFDict{
+			"ShadingType": 2,
+			"ColorSpace":  PDFName("DeviceRGB"),
+			"Coords":      PDFArray{x0, y0, x1, y1},
+			"Function": PDFDict{
+				"FunctionType": 2,
+				"Domain":       PDFArray{0.0, 1.0},
+				"C0":           PDFArray{c0[0], c0[1], c0[2]},
+				"C1":           PDFArray{c1[0], c1[1], c1[2]},
+				"N":            1,
+			},
+		})
+		p.writer.shadingRefs[key] = ref
+	}
+
+	name := PDFName(fmt.Sprintf("Sh%d", len(p.shadings)))
+	p.shadings[key] = name
+	p.resources["Shading"].(PDFDict)[name] = ref
+	return name
+}
+
+// Shade paints the shading registered as name (see GetAxialShading) across
+// the current clipping region, per the sh operator.
+func (p *PDFPage) Shade(name PDFName) {
+	p.op("/%v sh\n", name)
+}
+
+// GetTilingPattern registers a PaintType 1 (colored), TilingType 1 tiling
+// pattern whose cell is width x height user space units and whose content
+// stream is exactly draw, creating and registering the underlying
+// (document-shared) object if this is the first page to use it. Paint it
+// with SetFillPattern.
+func (p *PDFPage) GetTilingPattern(width, height float64, draw []byte) PDFName {
+	key := fmt.Sprintf("%v:%v:%s", width, height, draw)
+	if name, ok := p.patterns[key]; ok {
+		return name
+	}
+
+	ref, ok := p.writer.patternRefs[key]
+	if !ok {
+		ref = p.writer.WriteObject(PDFStream{
+			dict: PDFDict{
+				"Type":        PDFName("Pattern"),
+				"PatternType": 1,
+				"PaintType":   1,
+				"TilingType":  1,
+				"BBox":        PDFArray{0.0, 0.0, width, height},
+				"XStep":       width,
+				"YStep":       height,
+				"Resources":   PDFDict{},
+			},
+			filters: []PDFFilter{PDFFilterFlate},
+			b:       draw,
+		})
+		p.writer.patternRefs[key] = ref
+	}
+
+	name := PDFName(fmt.Sprintf("P%d", len(p.patterns)))
+	p.patterns[key] = name
+	p.resources["Pattern"].(PDFDict)[name] = ref
+	return name
+}
+
+// SetFillPattern sets the fill color space to Pattern and selects name
+// (from GetTilingPattern) as the current fill color, so that subsequent
+// Fill calls paint with it.
+func (p *PDFPage) SetFillPattern(name PDFName) {
+	p.op("/Pattern cs\n/%v scn\n", name)
+}
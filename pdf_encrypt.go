@@ -0,0 +1,363 @@
+package canvas
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+)
+
+// EncryptAlgo selects the standard security handler's encryption algorithm
+// installed by PDFWriter.Encrypt.
+type EncryptAlgo int
+
+const (
+	EncryptAES128 EncryptAlgo = iota // V4/R4: MD5-derived 128-bit key, AESV2 crypt filter
+	EncryptAES256                    // V5/R6: 256-bit key, AESV3 crypt filter (ISO 32000-2)
+)
+
+// Permissions is a bitmask of the standard security handler's /P entry,
+// i.e. what a viewer is allowed to do without the owner password.
+type Permissions uint32
+
+const (
+	PermPrint                   Permissions = 1 << 2
+	PermModify                  Permissions = 1 << 3
+	PermCopy                    Permissions = 1 << 4
+	PermAnnotate                Permissions = 1 << 5
+	PermFillForms               Permissions = 1 << 8
+	PermExtractForAccessibility Permissions = 1 << 9
+	PermAssemble                Permissions = 1 << 10
+	PermPrintHighRes            Permissions = 1 << 11
+)
+
+// pdfEncryptState holds everything needed to write the /Encrypt dictionary
+// and to encrypt every other string and stream in the document.
+type pdfEncryptState struct {
+	algo    EncryptAlgo
+	fileKey []byte // 16 bytes (EncryptAES128) or 32 bytes (EncryptAES256)
+	id1     []byte
+	id2     []byte
+	perms   int32
+
+	o, u       []byte
+	oE, uE     []byte // EncryptAES256 only
+	permsBlock []byte // EncryptAES256 only
+}
+
+// Encrypt installs a standard security handler on the document: userPwd is
+// required to open the file for viewing, ownerPwd (if non-empty) grants full
+// access and overrides perms. It must be called before Close.
+func (w *PDFWriter) Encrypt(userPwd, ownerPwd string, perms Permissions, algo EncryptAlgo) error {
+	if ownerPwd == "" {
+		ownerPwd = userPwd
+	}
+
+	id1 := randomBytes(16)
+	// Reserved bits 7-8 and 13-32 are set and bits 1-2 are left clear, with
+	// the explicit permission bits OR'd in on top.
+	reserved := uint32(0xFFFFF0C0)
+	state := &pdfEncryptState{
+		algo:  algo,
+		id1:   id1,
+		id2:   id1, // spec allows reusing id1 for a newly created file
+		perms: int32(reserved) | int32(perms),
+	}
+
+	switch algo {
+	case EncryptAES128:
+		state.o = computeOwnerHashR4(userPwd, ownerPwd, 16)
+		state.fileKey = computeFileKeyR4(userPwd, state.o, state.perms, id1, 16)
+		state.u = computeUserHashR4(state.fileKey, id1)
+	case EncryptAES256:
+		state.fileKey = randomBytes(32)
+
+		uValidationSalt, uKeySalt := randomBytes(8), randomBytes(8)
+		uHash := hardenedHash([]byte(userPwd), uValidationSalt, nil)
+		state.u = concat(uHash, uValidationSalt, uKeySalt)
+		state.uE = aesCBCNoPad(hardenedHash([]byte(userPwd), uKeySalt, nil), state.fileKey)
+
+		oValidationSalt, oKeySalt := randomBytes(8), randomBytes(8)
+		oHash := hardenedHash([]byte(ownerPwd), oValidationSalt, state.u)
+		state.o = concat(oHash, oValidationSalt, oKeySalt)
+		state.oE = aesCBCNoPad(hardenedHash([]byte(ownerPwd), oKeySalt, state.u), state.fileKey)
+
+		state.permsBlock = encryptPerms(state.fileKey, state.perms)
+	}
+
+	w.encrypt = state
+	return nil
+}
+
+// dict builds the /Encrypt dictionary describing the installed handler.
+func (e *pdfEncryptState) dict() PDFDict {
+	d := PDFDict{
+		"Filter":          PDFName("Standard"),
+		"O":               string(e.o),
+		"U":               string(e.u),
+		"P":               int(e.perms),
+		"StmF":            PDFName("StdCF"),
+		"StrF":            PDFName("StdCF"),
+		"EncryptMetadata": true,
+	}
+	switch e.algo {
+	case EncryptAES128:
+		d["V"], d["R"] = 4, 4
+		d["CF"] = PDFDict{"StdCF": PDFDict{
+			"CFM":       PDFName("AESV2"),
+			"AuthEvent": PDFName("DocOpen"),
+			"Length":    16,
+		}}
+	case EncryptAES256:
+		d["V"], d["R"] = 5, 6
+		d["OE"] = string(e.oE)
+		d["UE"] = string(e.uE)
+		d["Perms"] = string(e.permsBlock)
+		d["CF"] = PDFDict{"StdCF": PDFDict{
+			"CFM":       PDFName("AESV3"),
+			"AuthEvent": PDFName("DocOpen"),
+			"Length":    32,
+		}}
+	}
+	return d
+}
+
+// encrypt encrypts data (a string or already-filtered stream body) for
+// object number objNum, generation gen, per Algorithm 1/1.A: AES-CBC with a
+// random IV prepended to the ciphertext and PKCS#7 padding.
+func (e *pdfEncryptState) encrypt(data []byte, objNum, gen int) []byte {
+	key := e.objectKey(objNum, gen)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	iv := randomBytes(aes.BlockSize)
+	padded := pkcs7Pad(data, aes.BlockSize)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, padded)
+	return append(iv, out...)
+}
+
+// objectKey derives the per-object encryption key (Algorithm 1). AES-256
+// (V5) uses the file encryption key directly; RC4/AES-128 (V4) mixes in the
+// object number, generation and an "sAlT" constant that marks AES use.
+func (e *pdfEncryptState) objectKey(objNum, gen int) []byte {
+	if e.algo == EncryptAES256 {
+		return e.fileKey
+	}
+
+	h := md5.New()
+	h.Write(e.fileKey)
+	h.Write([]byte{byte(objNum), byte(objNum >> 8), byte(objNum >> 16), byte(gen), byte(gen >> 8)})
+	h.Write([]byte{0x73, 0x41, 0x6C, 0x54}) // "sAlT", marks the key for AES rather than RC4
+	sum := h.Sum(nil)
+
+	n := len(e.fileKey) + 5
+	if n > 16 {
+		n = 16
+	}
+	return sum[:n]
+}
+
+// pdfPasswordPad is the standard 32-byte password padding string (ISO
+// 32000-1 Algorithm 2, step (b)).
+var pdfPasswordPad = []byte{
+	0x28, 0xBF, 0x4E, 0x5E, 0x4E, 0x75, 0x8A, 0x41,
+	0x64, 0x00, 0x4E, 0x56, 0xFF, 0xFA, 0x01, 0x08,
+	0x2E, 0x2E, 0x00, 0xB6, 0xD0, 0x68, 0x3E, 0x80,
+	0x2F, 0x0C, 0xA9, 0xFE, 0x64, 0x53, 0x69, 0x7A,
+}
+
+func padPassword(pw string) []byte {
+	b := []byte(pw)
+	if len(b) >= 32 {
+		return b[:32]
+	}
+	return append(append([]byte{}, b...), pdfPasswordPad[:32-len(b)]...)
+}
+
+// computeOwnerHashR4 implements Algorithm 3 (R>=3): derive the /O entry
+// from the owner (falling back to the user) password.
+func computeOwnerHashR4(userPwd, ownerPwd string, n int) []byte {
+	digest := md5.Sum(padPassword(ownerPwd))
+	d := digest[:]
+	for i := 0; i < 50; i++ {
+		sum := md5.Sum(d[:n])
+		d = sum[:]
+	}
+	rc4Key := d[:n]
+
+	out := rc4Crypt(rc4Key, padPassword(userPwd))
+	for i := 1; i <= 19; i++ {
+		roundKey := make([]byte, n)
+		for j := 0; j < n; j++ {
+			roundKey[j] = rc4Key[j] ^ byte(i)
+		}
+		out = rc4Crypt(roundKey, out)
+	}
+	return out
+}
+
+// computeFileKeyR4 implements Algorithm 2 (R>=3): derive the file
+// encryption key from the user password, /O, /P and the first document ID.
+func computeFileKeyR4(userPwd string, o []byte, p int32, id1 []byte, n int) []byte {
+	h := md5.New()
+	h.Write(padPassword(userPwd))
+	h.Write(o)
+	h.Write([]byte{byte(p), byte(p >> 8), byte(p >> 16), byte(p >> 24)})
+	h.Write(id1)
+	// EncryptMetadata is always true, so Algorithm 2 step (f)'s extra
+	// 0xFFFFFFFF bytes (for unencrypted metadata) never apply here.
+	d := h.Sum(nil)
+	for i := 0; i < 50; i++ {
+		sum := md5.Sum(d[:n])
+		d = sum[:]
+	}
+	return append([]byte{}, d[:n]...)
+}
+
+// computeUserHashR4 implements Algorithm 5 (R>=3): derive the /U entry from
+// the file encryption key and first document ID.
+func computeUserHashR4(fileKey, id1 []byte) []byte {
+	h := md5.New()
+	h.Write(pdfPasswordPad)
+	h.Write(id1)
+	out := rc4Crypt(fileKey, h.Sum(nil))
+	for i := 1; i <= 19; i++ {
+		roundKey := make([]byte, len(fileKey))
+		for j := range fileKey {
+			roundKey[j] = fileKey[j] ^ byte(i)
+		}
+		out = rc4Crypt(roundKey, out)
+	}
+
+	u := make([]byte, 32)
+	copy(u, out)
+	copy(u[16:], pdfPasswordPad[:16]) // spec permits arbitrary padding here
+	return u
+}
+
+func rc4Crypt(key, data []byte) []byte {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(data))
+	c.XORKeyStream(out, data)
+	return out
+}
+
+// hardenedHash implements ISO 32000-2 Algorithm 2.B, the repeated
+// SHA-256/384/512 hashing used to turn a password (plus salt, plus - for
+// the owner - the already-computed /U) into a key.
+//
+// Passwords are assumed to already be valid UTF-8 and are merely truncated
+// to the spec's 127-byte limit; full SASLprep normalization is not applied.
+func hardenedHash(password, salt, extra []byte) []byte {
+	if len(password) > 127 {
+		password = password[:127]
+	}
+
+	k := sha256Sum(concat(password, salt, extra))
+	round := 0
+	for {
+		k1 := bytes.Repeat(concat(password, k, extra), 64)
+
+		block, err := aes.NewCipher(k[:16])
+		if err != nil {
+			panic(err)
+		}
+		e := make([]byte, len(k1))
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(e, k1)
+
+		sum := 0
+		for _, b := range e[:16] {
+			sum += int(b)
+		}
+		switch sum % 3 {
+		case 0:
+			k = sha256Sum(e)
+		case 1:
+			s := sha512.Sum384(e)
+			k = s[:]
+		case 2:
+			s := sha512.Sum512(e)
+			k = s[:]
+		}
+
+		round++
+		if round >= 64 && int(e[len(e)-1]) <= round-32 {
+			break
+		}
+	}
+	return k[:32]
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// aesCBCNoPad encrypts exactly len(data) bytes (a multiple of the AES block
+// size) with a zero IV and no padding, as used to wrap the file encryption
+// key into /UE and /OE.
+func aesCBCNoPad(key, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(out, data)
+	return out
+}
+
+// encryptPerms implements Algorithm 3.A: authenticate /P against the file
+// encryption key with a single AES-256 ECB block (no padding needed since
+// the input is exactly one block).
+func encryptPerms(fileKey []byte, p int32) []byte {
+	var block16 [16]byte
+	block16[0], block16[1], block16[2], block16[3] = byte(p), byte(p>>8), byte(p>>16), byte(p>>24)
+	block16[4], block16[5], block16[6], block16[7] = 0xFF, 0xFF, 0xFF, 0xFF
+	block16[8] = 'T' // EncryptMetadata is always true
+	block16[9], block16[10], block16[11] = 'a', 'd', 'b'
+	copy(block16[12:16], randomBytes(4))
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, 16)
+	block.Encrypt(out, block16[:])
+	return out
+}
+
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padLen := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data)+padLen)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+	return padded
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
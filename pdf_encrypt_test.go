@@ -0,0 +1,86 @@
+package canvas
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"testing"
+)
+
+// TestEncryptCloseRoundTrip writes a small encrypted document and confirms
+// that Close actually ran its content through AES encryption (rather than
+// leaving it in the clear): it derives the first page's content-stream
+// object key the same way the standard security handler does, decrypts the
+// stream with it, and checks the result inflates back to the operators the
+// page was drawn with.
+func TestEncryptCloseRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPDFWriter(&buf)
+	if err := w.Encrypt("user-pwd", "owner-pwd", PermPrint, EncryptAES128); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	page := w.NewPage(200, 200)
+	page.SetRGB(1, 0, 0)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	out := buf.Bytes()
+
+	if !bytes.Contains(out, []byte("/Filter/Standard")) && !bytes.Contains(out, []byte("/Filter /Standard")) {
+		t.Fatalf("/Encrypt dictionary not found in plaintext")
+	}
+
+	// The page's content stream is always the first object written by
+	// Close (see the "1 0 obj" assumption), before the page dict, Pages
+	// tree, fonts, or /Encrypt itself.
+	start := bytes.Index(out, []byte("1 0 obj\n"))
+	if start < 0 {
+		t.Fatalf("object 1 not found")
+	}
+	streamStart := bytes.Index(out[start:], []byte("stream\n")) + start + len("stream\n")
+	streamEnd := bytes.Index(out[streamStart:], []byte("\nendstream")) + streamStart
+	ciphertext := out[streamStart:streamEnd]
+
+	if len(ciphertext) < aes.BlockSize {
+		t.Fatalf("ciphertext too short to contain an IV: %d bytes", len(ciphertext))
+	}
+	iv, body := ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:]
+	if len(body)%aes.BlockSize != 0 {
+		t.Fatalf("ciphertext body (%d bytes) isn't a multiple of the AES block size", len(body))
+	}
+
+	key := w.encrypt.objectKey(1, 0)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	plain := make([]byte, len(body))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, body)
+	plain = pkcs7Unpad(plain)
+
+	zr, err := zlib.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		t.Fatalf("decrypted content isn't valid zlib (encryption/decryption mismatch?): %v", err)
+	}
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("inflating decrypted content: %v", err)
+	}
+	if !bytes.Contains(content, []byte("1 0 0 rg")) {
+		t.Fatalf("decrypted content stream missing expected operator, got: %q", content)
+	}
+}
+
+// pkcs7Unpad strips the PKCS#7 padding applied by pkcs7Pad.
+func pkcs7Unpad(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	n := int(data[len(data)-1])
+	if n <= 0 || n > len(data) {
+		return data
+	}
+	return data[:len(data)-n]
+}
@@ -0,0 +1,233 @@
+package canvas
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// pdfFontState tracks everything the document needs to remember about a
+// font between the first time it is referenced (via PDFPage.GetFont or
+// PDFWriter.EncodeString) and the point at which it is actually embedded, in
+// PDFWriter.finalizeFonts.
+type pdfFontState struct {
+	font *Font
+	ref  PDFRef // reserved object number for the /Type0 font dict
+
+	sfnt  *sfntFont
+	toGID map[rune]uint16 // Unicode code point -> original glyph ID, from 'cmap'
+	used  map[uint16]bool // original glyph IDs referenced via EncodeString
+}
+
+// registerFont returns the document's font state for f, parsing and
+// registering it the first time it is seen.
+func (w *PDFWriter) registerFont(f *Font) *pdfFontState {
+	if state, ok := w.fontStates[f]; ok {
+		return state
+	}
+
+	mimetype, data := f.Raw()
+	if mimetype != "font/ttf" {
+		panic("only TTF format support for embedding fonts in PDFs")
+	}
+	sfnt, err := parseSfnt(data)
+	if err != nil {
+		panic(fmt.Sprintf("canvas: invalid TTF font %q: %v", f.name, err))
+	}
+
+	state := &pdfFontState{
+		font:  f,
+		ref:   w.reserveRef(),
+		sfnt:  sfnt,
+		toGID: sfnt.cmap,
+		used:  map[uint16]bool{0: true}, // always keep .notdef
+	}
+	w.fontStates[f] = state
+	w.fontOrder = append(w.fontOrder, f)
+	return state
+}
+
+// EncodeString records the glyphs needed to render s in font f (so that
+// they survive subsetting) and returns s as a hex-encoded string of 2-byte
+// CIDs, ready to be wrapped in angle brackets and shown with the Tj/TJ
+// operators. Font f must already support the runes in s; glyphs without a
+// cmap entry fall back to CID 0 (.notdef).
+func (w *PDFWriter) EncodeString(f *Font, s string) []byte {
+	state := w.registerFont(f)
+
+	raw := make([]byte, 0, 2*len(s))
+	for _, r := range s {
+		gid := state.toGID[r]
+		state.used[gid] = true
+		raw = append(raw, byte(gid>>8), byte(gid))
+	}
+	return []byte(strings.ToUpper(hex.EncodeToString(raw)))
+}
+
+// finalizeFonts embeds every font registered with the document as a
+// composite Type0/CIDFontType2 font, subset down to the glyphs that were
+// actually used. Called once, from Close, after all pages have been drawn.
+func (w *PDFWriter) finalizeFonts() {
+	for _, f := range w.fontOrder {
+		w.embedFont(w.fontStates[f])
+	}
+}
+
+func (w *PDFWriter) embedFont(state *pdfFontState) {
+	sf := state.sfnt
+	used := closeOverComposites(sf, state.used)
+	newGlyf, newLoca := subsetGlyfTable(sf, used)
+
+	tables := make(map[string][]byte, len(sf.tables))
+	for tag, data := range sf.tables {
+		tables[tag] = data
+	}
+	tables["glyf"] = newGlyf
+	tables["loca"] = serializeLoca(newLoca, sf.indexToLocFormat)
+	fontFileBytes := buildSfnt(tables)
+
+	scale := func(v int16) int {
+		return int(v) * 1000 / int(sf.unitsPerEm)
+	}
+	scaleU := func(v uint16) int {
+		return int(v) * 1000 / int(sf.unitsPerEm)
+	}
+
+	fontFile := w.WriteObject(PDFStream{
+		dict: PDFDict{
+			"Length1": len(fontFileBytes),
+		},
+		filters: []PDFFilter{PDFFilterFlate},
+		b:       fontFileBytes,
+	})
+
+	flags := 32 // Nonsymbolic: we expose a Unicode cmap via ToUnicode
+	if sf.post.isFixedPitch {
+		flags |= 1
+	}
+	if sf.post.italicAngle != 0 {
+		flags |= 64
+	}
+
+	descriptor := w.WriteObject(PDFDict{
+		"Type":        PDFName("FontDescriptor"),
+		"FontName":    PDFName(state.font.name),
+		"Flags":       flags,
+		"FontBBox":    PDFArray{scale(sf.xMin), scale(sf.yMin), scale(sf.xMax), scale(sf.yMax)},
+		"ItalicAngle": sf.post.italicAngle,
+		"Ascent":      scale(sf.ascender),
+		"Descent":     scale(sf.descender),
+		"CapHeight":   scale(sf.capHeight),
+		"StemV":       estimateStemV(sf.weightClass),
+		"FontFile2":   fontFile,
+	})
+
+	cidFont := w.WriteObject(PDFDict{
+		"Type":           PDFName("Font"),
+		"Subtype":        PDFName("CIDFontType2"),
+		"BaseFont":       PDFName(state.font.name),
+		"CIDSystemInfo":  PDFDict{"Registry": "Adobe", "Ordering": "Identity", "Supplement": 0},
+		"FontDescriptor": descriptor,
+		"DW":             scaleU(sf.defaultAdvanceWidth),
+		"W":              buildWidthsArray(sf, used, scaleU),
+		// Subsetting here only zeroes out unused glyf entries, it never
+		// renumbers glyph IDs, so CID == GID and /Identity applies as-is.
+		"CIDToGIDMap": PDFName("Identity"),
+	})
+
+	toUnicode := w.WriteObject(PDFStream{
+		filters: []PDFFilter{PDFFilterFlate},
+		b:       buildToUnicodeCMap(state),
+	})
+
+	w.resolveObject(state.ref, PDFDict{
+		"Type":            PDFName("Font"),
+		"Subtype":         PDFName("Type0"),
+		"BaseFont":        PDFName(state.font.name),
+		"Encoding":        PDFName("Identity-H"),
+		"DescendantFonts": PDFArray{cidFont},
+		"ToUnicode":       toUnicode,
+	})
+}
+
+func estimateStemV(weightClass uint16) int {
+	// No direct StemV field exists in TrueType; approximate it from the
+	// OS/2 weight class the way most PDF producers do.
+	if weightClass == 0 {
+		weightClass = 400
+	}
+	return 50 + int(weightClass)/12
+}
+
+// buildWidthsArray returns a PDF /W array (CIDFontType2 glyph widths) for
+// the subset of glyphs in used, in the simple "c [w]" per-glyph form.
+func buildWidthsArray(sf *sfntFont, used map[uint16]bool, scale func(uint16) int) PDFArray {
+	gids := make([]int, 0, len(used))
+	for gid := range used {
+		gids = append(gids, int(gid))
+	}
+	sort.Ints(gids)
+
+	w := PDFArray{}
+	for _, gid := range gids {
+		w = append(w, gid, PDFArray{scale(sf.advanceWidth(uint16(gid)))})
+	}
+	return w
+}
+
+// buildToUnicodeCMap returns a /ToUnicode CMap stream mapping every used
+// glyph ID back to the Unicode code point(s) it was drawn for, so that text
+// extraction and search keep working after subsetting.
+func buildToUnicodeCMap(state *pdfFontState) []byte {
+	gidToRune := map[uint16]rune{}
+	for r, gid := range state.toGID {
+		if state.used[gid] {
+			gidToRune[gid] = r
+		}
+	}
+
+	gids := make([]int, 0, len(gidToRune))
+	for gid := range gidToRune {
+		gids = append(gids, int(gid))
+	}
+	sort.Ints(gids)
+
+	var b bytes.Buffer
+	b.WriteString("/CIDInit /ProcSet findresource begin\n")
+	b.WriteString("12 dict begin\nbegincmap\n")
+	b.WriteString("1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	// The CMap resource format caps each begin...end block at 100 entries,
+	// so chunk rather than emitting a single beginbfchar for every glyph.
+	for len(gids) > 0 {
+		n := maxBfCharEntries
+		if n > len(gids) {
+			n = len(gids)
+		}
+		chunk := gids[:n]
+		gids = gids[n:]
+
+		fmt.Fprintf(&b, "%d beginbfchar\n", len(chunk))
+		for _, gid := range chunk {
+			// Runes outside the Basic Multilingual Plane (e.g. emoji) don't
+			// fit in a single UTF-16BE code unit and must be written as a
+			// surrogate pair, per the /ToUnicode CMap's UTF-16BE encoding
+			// (PDF 32000-1 9.10.3).
+			units := utf16.Encode([]rune{gidToRune[uint16(gid)]})
+			var hexRune strings.Builder
+			for _, u := range units {
+				fmt.Fprintf(&hexRune, "%04X", u)
+			}
+			fmt.Fprintf(&b, "<%04X> <%v>\n", gid, hexRune.String())
+		}
+		b.WriteString("endbfchar\n")
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend")
+	return b.Bytes()
+}
+
+// maxBfCharEntries is the maximum number of mappings a single
+// beginbfchar/endbfchar block may contain, per the CMap resource format.
+const maxBfCharEntries = 100
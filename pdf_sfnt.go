@@ -0,0 +1,454 @@
+package canvas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// sfntFont is a minimal parse of the TrueType tables PDF font embedding
+// needs: metrics for the FontDescriptor, a cmap for Unicode -> glyph lookup,
+// and glyf/loca so glyphs can be subset.
+type sfntFont struct {
+	tables map[string][]byte
+
+	unitsPerEm       uint16
+	indexToLocFormat int16
+	xMin, yMin       int16
+	xMax, yMax       int16
+
+	ascender, descender int16
+	numHMetrics         uint16
+	hmtx                []uint16
+	defaultAdvanceWidth uint16
+
+	weightClass uint16
+	capHeight   int16
+
+	post struct {
+		italicAngle  float64
+		isFixedPitch bool
+	}
+
+	cmap map[rune]uint16 // Unicode code point -> original glyph ID
+
+	loca []uint32 // numGlyphs+1 offsets into the (original) glyf table
+	glyf []byte
+}
+
+// parseSfnt parses the table directory of a TrueType font and extracts the
+// tables required to embed and subset it in a PDF.
+func parseSfnt(data []byte) (*sfntFont, error) {
+	if len(data) < 12 {
+		return nil, errors.New("file too short")
+	}
+	numTables := int(binary.BigEndian.Uint16(data[4:6]))
+
+	tables := map[string][]byte{}
+	pos := 12
+	for i := 0; i < numTables; i++ {
+		if pos+16 > len(data) {
+			return nil, errors.New("truncated table directory")
+		}
+		tag := string(data[pos : pos+4])
+		offset := binary.BigEndian.Uint32(data[pos+8 : pos+12])
+		length := binary.BigEndian.Uint32(data[pos+12 : pos+16])
+		if int64(offset)+int64(length) > int64(len(data)) {
+			return nil, fmt.Errorf("table %q out of bounds", tag)
+		}
+		tables[tag] = data[offset : offset+length]
+		pos += 16
+	}
+
+	sf := &sfntFont{tables: tables}
+
+	head, ok := tables["head"]
+	if !ok || len(head) < 54 {
+		return nil, errors.New("missing or truncated head table")
+	}
+	sf.unitsPerEm = binary.BigEndian.Uint16(head[18:20])
+	sf.xMin = int16(binary.BigEndian.Uint16(head[36:38]))
+	sf.yMin = int16(binary.BigEndian.Uint16(head[38:40]))
+	sf.xMax = int16(binary.BigEndian.Uint16(head[40:42]))
+	sf.yMax = int16(binary.BigEndian.Uint16(head[42:44]))
+	sf.indexToLocFormat = int16(binary.BigEndian.Uint16(head[50:52]))
+	if sf.unitsPerEm == 0 {
+		sf.unitsPerEm = 1000
+	}
+
+	hhea, ok := tables["hhea"]
+	if !ok || len(hhea) < 36 {
+		return nil, errors.New("missing or truncated hhea table")
+	}
+	sf.ascender = int16(binary.BigEndian.Uint16(hhea[4:6]))
+	sf.descender = int16(binary.BigEndian.Uint16(hhea[6:8]))
+	sf.numHMetrics = binary.BigEndian.Uint16(hhea[34:36])
+
+	maxp, ok := tables["maxp"]
+	if !ok || len(maxp) < 6 {
+		return nil, errors.New("missing or truncated maxp table")
+	}
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:6]))
+
+	if os2, ok := tables["OS/2"]; ok {
+		if len(os2) >= 6 {
+			sf.weightClass = binary.BigEndian.Uint16(os2[4:6])
+		}
+		if len(os2) >= 90 {
+			sf.capHeight = int16(binary.BigEndian.Uint16(os2[88:90]))
+		}
+	}
+	if sf.capHeight == 0 {
+		sf.capHeight = sf.ascender
+	}
+
+	if post, ok := tables["post"]; ok && len(post) >= 32 {
+		sf.post.italicAngle = float64(int32(binary.BigEndian.Uint32(post[4:8]))) / 65536
+		sf.post.isFixedPitch = binary.BigEndian.Uint32(post[12:16]) != 0
+	}
+
+	hmtx, ok := tables["hmtx"]
+	if !ok {
+		return nil, errors.New("missing hmtx table")
+	}
+	for i := 0; i < int(sf.numHMetrics) && i*4+2 <= len(hmtx); i++ {
+		sf.hmtx = append(sf.hmtx, binary.BigEndian.Uint16(hmtx[i*4:i*4+2]))
+	}
+	if len(sf.hmtx) > 0 {
+		sf.defaultAdvanceWidth = sf.hmtx[len(sf.hmtx)-1]
+	}
+
+	loca, ok := tables["loca"]
+	if !ok {
+		return nil, errors.New("missing loca table")
+	}
+	sf.loca = parseLoca(loca, numGlyphs, sf.indexToLocFormat)
+
+	glyf, ok := tables["glyf"]
+	if !ok {
+		return nil, errors.New("missing glyf table")
+	}
+	sf.glyf = glyf
+
+	cmapTable, ok := tables["cmap"]
+	if !ok {
+		return nil, errors.New("missing cmap table")
+	}
+	cmap, err := parseCmap(cmapTable)
+	if err != nil {
+		return nil, err
+	}
+	sf.cmap = cmap
+
+	return sf, nil
+}
+
+// advanceWidth returns the glyph's advance width in font units, falling
+// back to the last hmtx entry for glyphs beyond numberOfHMetrics (as the
+// format requires for monospaced tails).
+func (sf *sfntFont) advanceWidth(gid uint16) uint16 {
+	if int(gid) < len(sf.hmtx) {
+		return sf.hmtx[gid]
+	}
+	return sf.defaultAdvanceWidth
+}
+
+func parseLoca(data []byte, numGlyphs int, format int16) []uint32 {
+	n := numGlyphs + 1
+	out := make([]uint32, n)
+	if format == 0 {
+		for i := 0; i < n && i*2+2 <= len(data); i++ {
+			out[i] = uint32(binary.BigEndian.Uint16(data[i*2:i*2+2])) * 2
+		}
+	} else {
+		for i := 0; i < n && i*4+4 <= len(data); i++ {
+			out[i] = binary.BigEndian.Uint32(data[i*4 : i*4+4])
+		}
+	}
+	return out
+}
+
+// serializeLoca re-encodes offsets as a 'loca' table in the given format.
+func serializeLoca(offsets []uint32, format int16) []byte {
+	var buf bytes.Buffer
+	for _, v := range offsets {
+		if format == 0 {
+			binary.Write(&buf, binary.BigEndian, uint16(v/2))
+		} else {
+			binary.Write(&buf, binary.BigEndian, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// parseCmap picks the best available (Platform, Encoding) subtable -
+// preferring Windows/Unicode full repertoire, then Windows/Unicode BMP,
+// then any Unicode platform - and parses it into a rune -> glyph ID map.
+func parseCmap(data []byte) (map[rune]uint16, error) {
+	if len(data) < 4 {
+		return nil, errors.New("cmap table too short")
+	}
+	numTables := int(binary.BigEndian.Uint16(data[2:4]))
+
+	var bestOffset uint32
+	bestScore := -1
+	for i := 0; i < numTables; i++ {
+		p := 4 + i*8
+		if p+8 > len(data) {
+			break
+		}
+		platformID := binary.BigEndian.Uint16(data[p : p+2])
+		encodingID := binary.BigEndian.Uint16(data[p+2 : p+4])
+		offset := binary.BigEndian.Uint32(data[p+4 : p+8])
+
+		score := -1
+		switch {
+		case platformID == 3 && encodingID == 10:
+			score = 4
+		case platformID == 3 && encodingID == 1:
+			score = 3
+		case platformID == 0:
+			score = 2
+		case platformID == 3 && encodingID == 0:
+			score = 1
+		}
+		if score > bestScore {
+			bestScore = score
+			bestOffset = offset
+		}
+	}
+	if bestScore < 0 {
+		return nil, errors.New("no usable Unicode cmap subtable")
+	}
+	if int64(bestOffset)+2 > int64(len(data)) {
+		return nil, errors.New("cmap subtable out of bounds")
+	}
+
+	sub := data[bestOffset:]
+	switch binary.BigEndian.Uint16(sub[0:2]) {
+	case 4:
+		return parseCmapFormat4(sub)
+	case 12:
+		return parseCmapFormat12(sub)
+	default:
+		return nil, fmt.Errorf("unsupported cmap subtable format %d", binary.BigEndian.Uint16(sub[0:2]))
+	}
+}
+
+func parseCmapFormat4(data []byte) (map[rune]uint16, error) {
+	if len(data) < 14 {
+		return nil, errors.New("cmap format 4 too short")
+	}
+	segCount := int(binary.BigEndian.Uint16(data[6:8])) / 2
+	endCodeOff := 14
+	startCodeOff := endCodeOff + segCount*2 + 2
+	idDeltaOff := startCodeOff + segCount*2
+	idRangeOff := idDeltaOff + segCount*2
+
+	result := map[rune]uint16{}
+	for i := 0; i < segCount; i++ {
+		if idRangeOff+i*2+2 > len(data) {
+			break
+		}
+		end := binary.BigEndian.Uint16(data[endCodeOff+i*2:])
+		start := binary.BigEndian.Uint16(data[startCodeOff+i*2:])
+		delta := int16(binary.BigEndian.Uint16(data[idDeltaOff+i*2:]))
+		rangeOffset := binary.BigEndian.Uint16(data[idRangeOff+i*2:])
+		if start == 0xFFFF && end == 0xFFFF {
+			continue
+		}
+		for c := int(start); c <= int(end); c++ {
+			var gid uint16
+			if rangeOffset == 0 {
+				gid = uint16(c + int(delta))
+			} else {
+				addr := idRangeOff + i*2 + int(rangeOffset) + 2*(c-int(start))
+				if addr+2 > len(data) {
+					continue
+				}
+				g := binary.BigEndian.Uint16(data[addr:])
+				if g == 0 {
+					continue
+				}
+				gid = uint16(int(g) + int(delta))
+			}
+			if gid != 0 {
+				result[rune(c)] = gid
+			}
+		}
+	}
+	return result, nil
+}
+
+func parseCmapFormat12(data []byte) (map[rune]uint16, error) {
+	if len(data) < 16 {
+		return nil, errors.New("cmap format 12 too short")
+	}
+	nGroups := binary.BigEndian.Uint32(data[12:16])
+
+	result := map[rune]uint16{}
+	for i := uint32(0); i < nGroups; i++ {
+		p := 16 + i*12
+		if int64(p)+12 > int64(len(data)) {
+			break
+		}
+		start := binary.BigEndian.Uint32(data[p : p+4])
+		end := binary.BigEndian.Uint32(data[p+4 : p+8])
+		startGID := binary.BigEndian.Uint32(data[p+8 : p+12])
+		for c := start; c <= end; c++ {
+			if gid := startGID + (c - start); gid <= 0xFFFF {
+				result[rune(c)] = uint16(gid)
+			}
+		}
+	}
+	return result, nil
+}
+
+// closeOverComposites returns used plus every glyph ID transitively
+// referenced by composite glyphs in used, so that subsetting never drops a
+// glyph another kept glyph depends on.
+func closeOverComposites(sf *sfntFont, used map[uint16]bool) map[uint16]bool {
+	out := map[uint16]bool{}
+	var visit func(gid uint16)
+	visit = func(gid uint16) {
+		if out[gid] {
+			return
+		}
+		out[gid] = true
+
+		if int(gid)+1 >= len(sf.loca) {
+			return
+		}
+		start, end := sf.loca[gid], sf.loca[gid+1]
+		if end <= start || int(end) > len(sf.glyf) {
+			return
+		}
+		glyph := sf.glyf[start:end]
+		if len(glyph) < 10 || int16(binary.BigEndian.Uint16(glyph[0:2])) >= 0 {
+			return // simple glyph, no components to follow
+		}
+
+		const (
+			argsAreWords   = 0x0001
+			haveScale      = 0x0008
+			moreComponents = 0x0020
+			haveXYScale    = 0x0040
+			haveTwoByTwo   = 0x0080
+		)
+		pos := 10
+		for pos+4 <= len(glyph) {
+			flags := binary.BigEndian.Uint16(glyph[pos : pos+2])
+			compGID := binary.BigEndian.Uint16(glyph[pos+2 : pos+4])
+			visit(compGID)
+			pos += 4
+			if flags&argsAreWords != 0 {
+				pos += 4
+			} else {
+				pos += 2
+			}
+			switch {
+			case flags&haveTwoByTwo != 0:
+				pos += 8
+			case flags&haveXYScale != 0:
+				pos += 4
+			case flags&haveScale != 0:
+				pos += 2
+			}
+			if flags&moreComponents == 0 {
+				break
+			}
+		}
+	}
+	for gid := range used {
+		visit(gid)
+	}
+	return out
+}
+
+// subsetGlyfTable rewrites the glyf table so that only the glyphs in used
+// keep their outline data; every other glyph becomes a zero-length entry.
+// Glyph IDs are never renumbered, so CIDToGIDMap can stay Identity. cmap and
+// hmtx are carried through unmodified: embedFont passes every other table
+// straight from sf.tables, so the embedded font is smaller but not as small
+// as it could be.
+func subsetGlyfTable(sf *sfntFont, used map[uint16]bool) (glyf []byte, loca []uint32) {
+	numGlyphs := len(sf.loca) - 1
+	loca = make([]uint32, len(sf.loca))
+
+	var buf bytes.Buffer
+	for gid := 0; gid < numGlyphs; gid++ {
+		loca[gid] = uint32(buf.Len())
+		if !used[uint16(gid)] {
+			continue
+		}
+		start, end := sf.loca[gid], sf.loca[gid+1]
+		if end <= start || int(end) > len(sf.glyf) {
+			continue
+		}
+		buf.Write(sf.glyf[start:end])
+		if buf.Len()%2 != 0 { // glyf entries must start on an even offset
+			buf.WriteByte(0)
+		}
+	}
+	loca[numGlyphs] = uint32(buf.Len())
+	return buf.Bytes(), loca
+}
+
+// buildSfnt reassembles a TrueType font file from a (possibly modified) set
+// of tables, in alphabetical tag order as required by the sfnt spec's
+// binary search table directory.
+func buildSfnt(tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	numTables := len(tags)
+	entrySelector := 0
+	for 1<<uint(entrySelector+1) <= numTables {
+		entrySelector++
+	}
+	searchRange := (1 << uint(entrySelector)) * 16
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, uint32(0x00010000))
+	binary.Write(&header, binary.BigEndian, uint16(numTables))
+	binary.Write(&header, binary.BigEndian, uint16(searchRange))
+	binary.Write(&header, binary.BigEndian, uint16(entrySelector))
+	binary.Write(&header, binary.BigEndian, uint16(numTables*16-searchRange))
+
+	offset := uint32(12 + 16*numTables)
+	var dir, body bytes.Buffer
+	for _, tag := range tags {
+		data := tables[tag]
+		padded := data
+		if rem := len(data) % 4; rem != 0 {
+			padded = append(append([]byte{}, data...), make([]byte, 4-rem)...)
+		}
+
+		dir.WriteString(tag)
+		binary.Write(&dir, binary.BigEndian, tableChecksum(padded))
+		binary.Write(&dir, binary.BigEndian, offset)
+		binary.Write(&dir, binary.BigEndian, uint32(len(data)))
+
+		body.Write(padded)
+		offset += uint32(len(padded))
+	}
+
+	var out bytes.Buffer
+	out.Write(header.Bytes())
+	out.Write(dir.Bytes())
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+func tableChecksum(padded []byte) uint32 {
+	var sum uint32
+	for i := 0; i+4 <= len(padded); i += 4 {
+		sum += binary.BigEndian.Uint32(padded[i : i+4])
+	}
+	return sum
+}
@@ -0,0 +1,159 @@
+package canvas
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// pdfSignPlaceholderSize is the number of bytes reserved for the detached
+// PKCS#7 signature in the /Contents hex string (so twice this many hex
+// digits). 16 KiB comfortably fits an RSA or ECDSA signature together with
+// a short certificate chain and its signed attributes; any unused
+// space is padded with trailing zero bytes, which verifiers ignore.
+const pdfSignPlaceholderSize = 16 * 1024
+
+// pdfByteRangePlaceholder is overwritten in place once the final file
+// offsets are known, so it must keep this exact length (four fixed-width
+// decimal fields) throughout.
+const pdfByteRangePlaceholder = "[0000000000 0000000000 0000000000 0000000000]"
+
+// pdfSignState holds everything needed to produce the detached PKCS#7
+// signature once the document's final byte layout is known, in Close.
+type pdfSignState struct {
+	signer   crypto.Signer
+	certs    []*x509.Certificate
+	reason   string
+	location string
+}
+
+// Sign installs a digital signature on the document: an invisible AcroForm
+// signature field is added covering the whole file, and once Close has
+// written every other object, a PKCS#7 detached signature
+// over the file's /ByteRange is computed and patched into its placeholder
+// /Contents. signer and certs[0] must correspond to the same key pair;
+// certs[1:], if any, are included as the chain up to (not including) a
+// trust anchor the verifier is expected to already have.
+func (w *PDFWriter) Sign(signer crypto.Signer, certs []*x509.Certificate, reason, location string) {
+	w.sign = &pdfSignState{signer: signer, certs: certs, reason: reason, location: location}
+}
+
+// writeSignatureField writes the /Sig dictionary, its widget annotation
+// (reusing the object number reserved for refWidget so the first page's
+// /Annots could already refer to it) and the document's /AcroForm.
+// refPage is the owning page, for the widget's required /P entry.
+func (w *PDFWriter) writeSignatureField(refWidget, refAcroForm, refPage PDFRef) {
+	contents := PDFRaw("<" + strings.Repeat("0", 2*pdfSignPlaceholderSize) + ">")
+
+	// The Sig dict must be a plain, uncompressed object regardless of
+	// PDFCompress: its /ByteRange and /Contents placeholders are found and
+	// patched by searching the final file's raw bytes in finalizeSignature,
+	// which wouldn't be possible if they ended up FlateDecode'd away inside
+	// an ObjStm.
+	sig := w.reserveRef()
+	w.writeDirectObject(sig, PDFDict{
+		"Type":      PDFName("Sig"),
+		"Filter":    PDFName("Adobe.PPKLite"),
+		"SubFilter": PDFName("adbe.pkcs7.detached"),
+		"ByteRange": PDFRaw(pdfByteRangePlaceholder),
+		"Contents":  contents,
+		"Reason":    w.sign.reason,
+		"Location":  w.sign.location,
+		"M":         pdfDate(time.Now()),
+	})
+
+	w.resolveObject(refWidget, PDFDict{
+		"Type":    PDFName("Annot"),
+		"Subtype": PDFName("Widget"),
+		"FT":      PDFName("Sig"),
+		"Rect":    PDFArray{0.0, 0.0, 0.0, 0.0},
+		"F":       2, // Hidden: the field has no visible appearance
+		"T":       "Signature1",
+		"V":       sig,
+		"P":       refPage,
+	})
+
+	w.resolveObject(refAcroForm, PDFDict{
+		"Fields":   PDFArray{refWidget},
+		"SigFlags": 3, // SignaturesExist | AppendOnly
+	})
+}
+
+// pdfDate formats t as a PDF date string, e.g. "D:20060102150405Z".
+func pdfDate(t time.Time) string {
+	return "D:" + t.UTC().Format("20060102150405") + "Z"
+}
+
+// finalizeSignature reads back the buffered document, computes the
+// detached PKCS#7 signature over its /ByteRange, patches the placeholder
+// /ByteRange and /Contents in place, and writes the final bytes to dst.
+func (w *PDFWriter) finalizeSignature(dst io.Writer) error {
+	buf := w.w.(*bytes.Buffer).Bytes()
+
+	placeholder := []byte("<" + strings.Repeat("0", 2*pdfSignPlaceholderSize) + ">")
+	contentsStart := bytes.Index(buf, placeholder)
+	if contentsStart < 0 {
+		return fmt.Errorf("canvas: signature /Contents placeholder not found")
+	}
+	hexStart := contentsStart + 1
+	hexEnd := contentsStart + len(placeholder) - 1
+
+	byteRange := fmt.Sprintf("[%-10d %-10d %-10d %-10d]", 0, hexStart, hexEnd, len(buf)-hexEnd)
+	brStart := bytes.Index(buf, []byte(pdfByteRangePlaceholder))
+	if brStart < 0 {
+		return fmt.Errorf("canvas: signature /ByteRange placeholder not found")
+	}
+	copy(buf[brStart:brStart+len(pdfByteRangePlaceholder)], byteRange)
+
+	signedBytes := append(append([]byte{}, buf[:hexStart]...), buf[hexEnd:]...)
+	der, err := w.sign.detachedSignature(signedBytes)
+	if err != nil {
+		return err
+	}
+	if len(der) > pdfSignPlaceholderSize {
+		return fmt.Errorf("canvas: PKCS#7 signature (%d bytes) exceeds the %d byte placeholder", len(der), pdfSignPlaceholderSize)
+	}
+
+	hexSig := strings.ToUpper(hex.EncodeToString(der))
+	copy(buf[hexStart:], hexSig)
+	// The rest of the placeholder's hex digits (already '0') are left as
+	// trailing padding, which every PDF reader ignores.
+
+	_, err = dst.Write(buf)
+	return err
+}
+
+// detachedSignature produces a PKCS#7 detached signature over data: the
+// signed attributes include the signing time, so the signature also asserts
+// when it was produced. No signing-certificate-v2 attribute is added, so the
+// result is not a full CAdES-BES signature.
+func (s *pdfSignState) detachedSignature(data []byte) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(data)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+
+	var parents []*x509.Certificate
+	if len(s.certs) > 1 {
+		parents = s.certs[1:]
+	}
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: pkcs7.OIDAttributeSigningTime, Value: time.Now().UTC()},
+		},
+	}
+	if err := sd.AddSignerChain(s.certs[0], s.signer, parents, config); err != nil {
+		return nil, err
+	}
+
+	sd.Detach()
+	return sd.Finish()
+}
@@ -0,0 +1,139 @@
+package canvas
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// pdfXrefKind mirrors the /Type field of a row in a PDF 1.5+ cross-reference
+// stream: 0 for a free object, 1 for a classic uncompressed object (offset
+// in the file), 2 for an object compressed inside an object stream.
+type pdfXrefKind byte
+
+const (
+	pdfXrefFree         pdfXrefKind = 0
+	pdfXrefUncompressed pdfXrefKind = 1
+	pdfXrefCompressed   pdfXrefKind = 2
+)
+
+// pdfXrefEntry is one row of the document's cross-reference table, indexed
+// by (object number - 1).
+type pdfXrefEntry struct {
+	kind pdfXrefKind
+	a, b int // uncompressed: a=offset, b=generation (always 0); compressed: a=ObjStm object number, b=index within it
+}
+
+// pdfObjStmBatchSize caps the number of objects per ObjStm, matching the
+// batching pdfcpu uses.
+const pdfObjStmBatchSize = 100
+
+// pdfPendingObject is a non-stream object waiting to be flushed into an
+// ObjStm.
+type pdfPendingObject struct {
+	num  int
+	body []byte
+}
+
+// renderVal serializes val the same way writeVal would write it to the
+// document, but into an in-memory buffer instead of the writer's output.
+func (w *PDFWriter) renderVal(val interface{}) []byte {
+	origW, origPos, origErr := w.w, w.pos, w.err
+	var buf bytes.Buffer
+	w.w, w.pos, w.err = &buf, 0, nil
+	w.writeVal(val)
+	w.w, w.pos, w.err = origW, origPos, origErr
+	return buf.Bytes()
+}
+
+// bufferCompressedObject buffers val, already assigned to ref, for inclusion
+// in the next ObjStm.
+func (w *PDFWriter) bufferCompressedObject(ref PDFRef, val interface{}) {
+	w.xref[int(ref)-1] = pdfXrefEntry{kind: pdfXrefCompressed}
+	w.objStm = append(w.objStm, pdfPendingObject{num: int(ref), body: w.renderVal(val)})
+	if len(w.objStm) >= pdfObjStmBatchSize {
+		w.flushObjStm()
+	}
+}
+
+// flushObjStm writes out any objects buffered by bufferCompressedObject as a
+// single compressed object stream and back-fills their xref entries.
+func (w *PDFWriter) flushObjStm() {
+	if len(w.objStm) == 0 {
+		return
+	}
+
+	var header, bodies bytes.Buffer
+	for _, obj := range w.objStm {
+		fmt.Fprintf(&header, "%d %d ", obj.num, bodies.Len())
+		bodies.Write(obj.body)
+		bodies.WriteByte(' ')
+	}
+
+	objStmRef := w.reserveRef()
+	w.writeDirectObject(objStmRef, PDFStream{
+		dict: PDFDict{
+			"Type":  PDFName("ObjStm"),
+			"N":     len(w.objStm),
+			"First": header.Len(),
+		},
+		filters: []PDFFilter{PDFFilterFlate},
+		b:       append(header.Bytes(), bodies.Bytes()...),
+	})
+
+	for i, obj := range w.objStm {
+		w.xref[obj.num-1] = pdfXrefEntry{kind: pdfXrefCompressed, a: int(objStmRef), b: i}
+	}
+	w.objStm = nil
+}
+
+// writeXRefStream writes the document's objects table as a PDF 1.5+
+// cross-reference stream (/Type /XRef) instead of the classic plain-text
+// xref table. The matching %PDF-1.5 header is written by NewPDFWriter.
+func (w *PDFWriter) writeXRefStream(refCatalog, refEncrypt PDFRef) error {
+	// The xref stream object describes itself too, so reserve its number
+	// and offset before encoding the table.
+	xrefNum := len(w.xref) + 1
+	xrefOffset := w.pos
+	w.xref = append(w.xref, pdfXrefEntry{kind: pdfXrefUncompressed, a: xrefOffset})
+
+	// W [1 4 2]: 1-byte type, 4-byte offset/ObjStm-number, 2-byte
+	// generation/index-within-ObjStm.
+	var table bytes.Buffer
+	table.WriteByte(0) // object 0: always free, head of the free list
+	writeUint32(&table, 0)
+	writeUint16(&table, 65535)
+	for _, entry := range w.xref {
+		table.WriteByte(byte(entry.kind))
+		writeUint32(&table, uint32(entry.a))
+		writeUint16(&table, uint16(entry.b))
+	}
+
+	dict := w.trailerDict(refCatalog, refEncrypt)
+	dict["Type"] = PDFName("XRef")
+	dict["W"] = PDFArray{1, 4, 2}
+	dict["Size"] = xrefNum + 1
+
+	// Cross-reference streams are explicitly exempt from encryption.
+	w.encryptSuppressed = true
+	w.writeDirectObject(PDFRef(xrefNum), PDFStream{
+		dict:    dict,
+		filters: []PDFFilter{PDFFilterFlate},
+		b:       table.Bytes(),
+	})
+	w.encryptSuppressed = false
+
+	w.write("\nstartxref\n%v\n%%%%EOF", xrefOffset)
+	return w.err
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	buf.WriteByte(byte(v >> 24))
+	buf.WriteByte(byte(v >> 16))
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v))
+}
+
+func writeUint16(buf *bytes.Buffer, v uint16) {
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v))
+}